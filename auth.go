@@ -0,0 +1,149 @@
+package riak
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// AuthOptions configures Riak Security for a Node's connections. When set
+// on NodeOptions, createNewConnection performs the RpbStartTls/RpbAuthReq
+// handshake before a connection is considered ready to use.
+type AuthOptions struct {
+	User               string
+	Password           string
+	ClientCert         *tls.Certificate
+	RootCAs            *x509.CertPool
+	InsecureSkipVerify bool
+}
+
+// ErrAuthFailed is returned when the StartTls/AuthReq handshake fails for
+// any reason; the connection must be discarded rather than reused.
+var ErrAuthFailed = errors.New("[Node] Riak security handshake failed")
+
+// Riak protobuf message codes involved in the security handshake.
+const (
+	rpbStartTlsCode byte = 255
+	rpbAuthReqCode  byte = 253
+	rpbAuthRespCode byte = 254
+)
+
+// startTlsAndAuth runs the Riak Security handshake against an already
+// connected c: it asks the server to upgrade to TLS with RpbStartTls,
+// performs the TLS handshake, then sends RpbAuthReq with the configured
+// credentials and waits for RpbAuthResp. The whole handshake is bounded by
+// ConnectTimeout so a slow or silent peer can't hang createNewConnection
+// (and, through it, callers holding connMtx) forever.
+func (n *Node) startTlsAndAuth(c *connection) error {
+	auth := n.authOptions
+
+	if err := c.conn.SetDeadline(time.Now().Add(n.connectTimeout)); err != nil {
+		return fmt.Errorf("%w: setting handshake deadline: %v", ErrAuthFailed, err)
+	}
+
+	if err := writeRpbMessage(c.conn, rpbStartTlsCode, nil); err != nil {
+		return fmt.Errorf("%w: sending RpbStartTls: %v", ErrAuthFailed, err)
+	}
+	if code, _, err := readRpbMessage(c.conn); err != nil {
+		return fmt.Errorf("%w: awaiting RpbStartTls response: %v", ErrAuthFailed, err)
+	} else if code != rpbStartTlsCode {
+		return fmt.Errorf("%w: unexpected response code %d to RpbStartTls", ErrAuthFailed, code)
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         n.host,
+		InsecureSkipVerify: auth.InsecureSkipVerify,
+		RootCAs:            auth.RootCAs,
+	}
+	if auth.ClientCert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*auth.ClientCert}
+	}
+
+	tlsConn := tls.Client(c.conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return fmt.Errorf("%w: TLS handshake: %v", ErrAuthFailed, err)
+	}
+	c.conn = tlsConn
+
+	if err := writeRpbMessage(c.conn, rpbAuthReqCode, encodeRpbAuthReq(auth.User, auth.Password)); err != nil {
+		return fmt.Errorf("%w: sending RpbAuthReq: %v", ErrAuthFailed, err)
+	}
+
+	code, _, err := readRpbMessage(c.conn)
+	if err != nil {
+		return fmt.Errorf("%w: awaiting RpbAuthResp: %v", ErrAuthFailed, err)
+	}
+	if code != rpbAuthRespCode {
+		return fmt.Errorf("%w: unexpected response code %d to RpbAuthReq", ErrAuthFailed, code)
+	}
+
+	if err := c.conn.SetDeadline(time.Time{}); err != nil {
+		return fmt.Errorf("%w: clearing handshake deadline: %v", ErrAuthFailed, err)
+	}
+
+	return nil
+}
+
+// writeRpbMessage writes a Riak protobuf frame: a 4-byte big-endian length
+// covering the message code and payload, followed by the code and payload
+// themselves.
+func writeRpbMessage(w io.Writer, code byte, payload []byte) error {
+	buf := make([]byte, 4+1+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)+1))
+	buf[4] = code
+	copy(buf[5:], payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+// readRpbMessage reads a single Riak protobuf frame and splits it into its
+// message code and payload.
+func readRpbMessage(r io.Reader) (code byte, payload []byte, err error) {
+	var lengthBuf [4]byte
+	if _, err = io.ReadFull(r, lengthBuf[:]); err != nil {
+		return
+	}
+
+	length := binary.BigEndian.Uint32(lengthBuf[:])
+	if length == 0 {
+		return 0, nil, errors.New("[Node] empty Riak protobuf response")
+	}
+
+	body := make([]byte, length)
+	if _, err = io.ReadFull(r, body); err != nil {
+		return
+	}
+
+	code = body[0]
+	payload = body[1:]
+	return
+}
+
+// encodeRpbAuthReq hand-encodes an RpbAuthReq (user=field 1, password=field
+// 2, both length-delimited strings) using the protobuf wire format
+// directly; this snapshot doesn't carry the generated riak_pb bindings the
+// rest of the client relies on for other messages.
+func encodeRpbAuthReq(user, password string) []byte {
+	var buf []byte
+	buf = appendProtoString(buf, 1, user)
+	buf = appendProtoString(buf, 2, password)
+	return buf
+}
+
+func appendProtoString(buf []byte, fieldNum int, s string) []byte {
+	buf = append(buf, byte(fieldNum<<3)|2) // wire type 2: length-delimited
+	buf = appendVarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func appendVarint(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(buf, byte(v))
+}
@@ -0,0 +1,209 @@
+package riak
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrNoHealthyNodes is returned by Cluster.Execute when every Node is
+// currently HEALTH_CHECKING or SHUTDOWN.
+var ErrNoHealthyNodes = errors.New("[Cluster] no healthy nodes available")
+
+const defaultExecutionAttempts = 3
+
+// ClusterOptions configures a Cluster.
+type ClusterOptions struct {
+	Nodes []*Node
+	// NodeManager selects which Node runs a given Command. Defaults to a
+	// RoundRobinNodeManager built from ExecutionAttempts.
+	NodeManager NodeManager
+	// ExecutionAttempts is only used to build the default NodeManager; it
+	// has no effect when NodeManager is set explicitly.
+	ExecutionAttempts int
+}
+
+// Cluster dispatches Commands across a set of Nodes via a pluggable
+// NodeManager, removing nodes from selection while they're
+// HEALTH_CHECKING or SHUTDOWN and restoring them once they recover.
+type Cluster struct {
+	stateMtx sync.RWMutex
+	state    state
+
+	nodeMtx         sync.RWMutex
+	nodes           []*Node
+	healthyNodes    map[*Node]bool
+	subscriptionIDs map[*Node]uint64
+
+	nodeManager NodeManager
+}
+
+func NewCluster(options *ClusterOptions) (*Cluster, error) {
+	if options == nil || len(options.Nodes) == 0 {
+		return nil, errors.New("[Cluster] at least one Node is required")
+	}
+
+	nodeManager := options.NodeManager
+	if nodeManager == nil {
+		executionAttempts := options.ExecutionAttempts
+		if executionAttempts == 0 {
+			executionAttempts = defaultExecutionAttempts
+		}
+		nodeManager = NewRoundRobinNodeManager(executionAttempts)
+	}
+
+	nodes := make([]*Node, len(options.Nodes))
+	copy(nodes, options.Nodes)
+
+	return &Cluster{
+		state:           CREATED,
+		nodes:           nodes,
+		healthyNodes:    make(map[*Node]bool, len(nodes)),
+		subscriptionIDs: make(map[*Node]uint64, len(nodes)),
+		nodeManager:     nodeManager,
+	}, nil
+}
+
+// exported funcs
+
+func (c *Cluster) Start() (err error) {
+	if err = c.stateCheck(CREATED); err != nil {
+		return
+	}
+
+	var started []*Node
+	c.nodeMtx.Lock()
+	for _, n := range c.nodes {
+		id, events := n.Subscribe()
+		c.subscriptionIDs[n] = id
+		go c.watchNode(n, events)
+
+		if err = n.Start(); err != nil {
+			n.Unsubscribe(id)
+			delete(c.subscriptionIDs, n)
+			c.nodeMtx.Unlock()
+			c.rollbackStart(started)
+			c.setState(ERROR)
+			return
+		}
+		c.healthyNodes[n] = true
+		started = append(started, n)
+	}
+	c.nodeMtx.Unlock()
+
+	c.setState(RUNNING)
+	return
+}
+
+// rollbackStart unsubscribes from and stops every Node that was
+// successfully started earlier in a Start() call that later failed partway
+// through, so a partial failure never leaves a Node running with nothing
+// tracking its subscription, and never leaves Cluster in a state where a
+// retried Start() would resubscribe already-running Nodes and leak the
+// earlier subscription's watchNode goroutine.
+func (c *Cluster) rollbackStart(started []*Node) {
+	c.nodeMtx.Lock()
+	for _, n := range started {
+		if id, ok := c.subscriptionIDs[n]; ok {
+			n.Unsubscribe(id)
+			delete(c.subscriptionIDs, n)
+		}
+		delete(c.healthyNodes, n)
+	}
+	c.nodeMtx.Unlock()
+
+	for _, n := range started {
+		if serr := n.Stop(); serr != nil {
+			logDebug("[Cluster] (%v) rollback: failed to stop node %v: %v", c, n, serr)
+		}
+	}
+}
+
+func (c *Cluster) Stop() (err error) {
+	if err = c.stateCheck(RUNNING); err != nil {
+		return
+	}
+	c.setState(SHUTTING_DOWN)
+
+	c.nodeMtx.Lock()
+	for n, id := range c.subscriptionIDs {
+		n.Unsubscribe(id)
+		delete(c.subscriptionIDs, n)
+	}
+	c.nodeMtx.Unlock()
+
+	for _, n := range c.nodes {
+		if serr := n.Stop(); serr != nil {
+			err = serr
+		}
+	}
+
+	c.setState(SHUTDOWN)
+	return
+}
+
+// Execute dispatches cmd to a healthy Node via the Cluster's NodeManager.
+func (c *Cluster) Execute(cmd Command) (executed bool, err error) {
+	if err = c.stateCheck(RUNNING); err != nil {
+		return
+	}
+
+	nodes := c.healthyNodesSnapshot()
+	if len(nodes) == 0 {
+		return false, ErrNoHealthyNodes
+	}
+
+	return c.nodeManager.ExecuteOnNode(nodes, cmd, nil)
+}
+
+func (c *Cluster) String() string {
+	c.nodeMtx.RLock()
+	defer c.nodeMtx.RUnlock()
+	return fmt.Sprintf("Cluster<%d nodes>", len(c.nodes))
+}
+
+// non-exported funcs
+
+// watchNode keeps healthyNodes in sync with n's reported state until its
+// events channel is closed by Unsubscribe (during Stop()).
+func (c *Cluster) watchNode(n *Node, events <-chan StateChangeEvent) {
+	for evt := range events {
+		c.nodeMtx.Lock()
+		c.healthyNodes[n] = evt.Current == RUNNING
+		c.nodeMtx.Unlock()
+	}
+}
+
+func (c *Cluster) healthyNodesSnapshot() []*Node {
+	c.nodeMtx.RLock()
+	defer c.nodeMtx.RUnlock()
+	nodes := make([]*Node, 0, len(c.nodes))
+	for _, n := range c.nodes {
+		if c.healthyNodes[n] {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+func (c *Cluster) setState(s state) {
+	c.stateMtx.Lock()
+	defer c.stateMtx.Unlock()
+	c.state = s
+}
+
+func (c *Cluster) stateCheck(allowed ...state) (err error) {
+	c.stateMtx.RLock()
+	defer c.stateMtx.RUnlock()
+	stateChecked := false
+	for _, s := range allowed {
+		if c.state == s {
+			stateChecked = true
+			break
+		}
+	}
+	if !stateChecked {
+		err = fmt.Errorf("[Cluster]: Illegal State; required %s: current: %s", allowed, c.state)
+	}
+	return
+}
@@ -0,0 +1,127 @@
+package riak
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCluster_StartTracksHealthyNodesAndStopCleansUp(t *testing.T) {
+	addr1, stop1 := startTestListener(t)
+	defer stop1()
+	addr2, stop2 := startTestListener(t)
+	defer stop2()
+
+	n1, err := NewNode(&NodeOptions{RemoteAddress: addr1, MinConnections: 1, MaxConnections: 1})
+	if err != nil {
+		t.Fatalf("NewNode() returned error: %v", err)
+	}
+	n2, err := NewNode(&NodeOptions{RemoteAddress: addr2, MinConnections: 1, MaxConnections: 1})
+	if err != nil {
+		t.Fatalf("NewNode() returned error: %v", err)
+	}
+
+	cluster, err := NewCluster(&ClusterOptions{Nodes: []*Node{n1, n2}})
+	if err != nil {
+		t.Fatalf("NewCluster() returned error: %v", err)
+	}
+
+	if err = cluster.Start(); err != nil {
+		t.Fatalf("Start() returned error: %v", err)
+	}
+
+	nodes := cluster.healthyNodesSnapshot()
+	if len(nodes) != 2 {
+		t.Fatalf("expected 2 healthy nodes after Start(), got %d", len(nodes))
+	}
+
+	if err = cluster.Stop(); err != nil {
+		t.Fatalf("Stop() returned error: %v", err)
+	}
+
+	if len(cluster.subscriptionIDs) != 0 {
+		t.Fatalf("expected subscriptions to be cleared after Stop(), got %d", len(cluster.subscriptionIDs))
+	}
+}
+
+func TestCluster_UnhealthyNodeRemovedFromSelection(t *testing.T) {
+	addr1, stop1 := startTestListener(t)
+	addr2, stop2 := startTestListener(t)
+	defer stop2()
+
+	n1, _ := NewNode(&NodeOptions{RemoteAddress: addr1, MinConnections: 1, MaxConnections: 1})
+	n2, _ := NewNode(&NodeOptions{RemoteAddress: addr2, MinConnections: 1, MaxConnections: 1})
+
+	cluster, err := NewCluster(&ClusterOptions{Nodes: []*Node{n1, n2}})
+	if err != nil {
+		t.Fatalf("NewCluster() returned error: %v", err)
+	}
+	if err = cluster.Start(); err != nil {
+		t.Fatalf("Start() returned error: %v", err)
+	}
+	defer cluster.Stop()
+
+	// kill n1's listener first so its health check can't immediately
+	// recover and flip it back to healthy before we observe it.
+	stop1()
+	n1.beginHealthCheck()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if len(cluster.healthyNodesSnapshot()) == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	nodes := cluster.healthyNodesSnapshot()
+	if len(nodes) != 1 || nodes[0] != n2 {
+		t.Fatalf("expected only n2 to remain healthy, got %v", nodes)
+	}
+}
+
+func TestCluster_StartRollsBackOnPartialFailure(t *testing.T) {
+	addr1, stop1 := startTestListener(t)
+	defer stop1()
+	addr2, stop2 := startTestListener(t)
+	defer stop2()
+
+	n1, err := NewNode(&NodeOptions{RemoteAddress: addr1, MinConnections: 1, MaxConnections: 1})
+	if err != nil {
+		t.Fatalf("NewNode() returned error: %v", err)
+	}
+	n2, err := NewNode(&NodeOptions{RemoteAddress: addr2, MinConnections: 1, MaxConnections: 1})
+	if err != nil {
+		t.Fatalf("NewNode() returned error: %v", err)
+	}
+
+	// Start n2 outside the cluster so cluster.Start() finds it already
+	// RUNNING and fails partway through, after n1 has already been started.
+	if err = n2.Start(); err != nil {
+		t.Fatalf("n2.Start() returned error: %v", err)
+	}
+	defer n2.Stop()
+
+	cluster, err := NewCluster(&ClusterOptions{Nodes: []*Node{n1, n2}})
+	if err != nil {
+		t.Fatalf("NewCluster() returned error: %v", err)
+	}
+
+	if err = cluster.Start(); err == nil {
+		t.Fatal("expected Start() to fail because n2 was already running")
+	}
+
+	n1.stateMtx.RLock()
+	st := n1.state
+	n1.stateMtx.RUnlock()
+	if st != SHUTDOWN {
+		t.Fatalf("expected n1 to be rolled back to SHUTDOWN, got %v", st)
+	}
+
+	if len(cluster.subscriptionIDs) != 0 {
+		t.Fatalf("expected no leaked subscriptions after rollback, got %d", len(cluster.subscriptionIDs))
+	}
+
+	if err = cluster.Start(); err == nil {
+		t.Fatal("expected a retried Start() to be rejected once Cluster is in ERROR")
+	}
+}
@@ -1,13 +1,15 @@
 package riak
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math/rand"
 	"net"
 	"sync"
 	"time"
 )
 
-// TODO auth
 type NodeOptions struct {
 	RemoteAddress      string
 	MinConnections     uint16
@@ -16,23 +18,56 @@ type NodeOptions struct {
 	ConnectTimeout     time.Duration
 	RequestTimeout     time.Duration
 	HealthCheckBuilder CommandBuilder
+	AuthOptions        *AuthOptions
 }
 
+// Node's host field retains RemoteAddress's original hostname: addr is a
+// resolved *net.TCPAddr and can't supply it back for TLS ServerName.
 type Node struct {
 	stateMtx              sync.RWMutex
 	connMtx               sync.RWMutex
 	addr                  *net.TCPAddr
+	host                  string
 	minConnections        uint16
 	maxConnections        uint16
 	idleTimeout           time.Duration
 	connectTimeout        time.Duration
 	requestTimeout        time.Duration
 	healthCheckBuilder    CommandBuilder
-	available             []*connection
+	authOptions           *AuthOptions
+	available             chan *connection
+	poolClosed            bool
 	currentNumConnections uint16
 	state                 state
+	expireTicker          *time.Ticker
+	stopCh                chan struct{}
+	healthCheckStopCh     chan struct{}
+	subMtx                sync.Mutex
+	subscribers           map[uint64]chan StateChangeEvent
+	nextSubscriberID      uint64
 }
 
+// stateChangeEventBuffer is the per-subscriber channel capacity returned by
+// Subscribe(). A subscriber that falls this far behind has events dropped
+// rather than stalling state transitions.
+const stateChangeEventBuffer = 16
+
+// StateChangeEvent describes a Node transitioning from one state to
+// another, delivered to subscribers registered via Node.Subscribe().
+type StateChangeEvent struct {
+	Previous state
+	Current  state
+}
+
+// healthCheckInitialBackoff and healthCheckMaxBackoff bound the exponential
+// backoff schedule used while a Node is HEALTH_CHECKING: delays start at
+// healthCheckInitialBackoff and double on every failed attempt, capped at
+// healthCheckMaxBackoff.
+const (
+	healthCheckInitialBackoff = 100 * time.Millisecond
+	healthCheckMaxBackoff     = 30 * time.Second
+)
+
 type state byte
 
 const (
@@ -60,6 +95,15 @@ func (v state) String() (rv string) {
 	return
 }
 
+// ErrPoolFull is returned by getAvailableConnection when MaxConnections are
+// already in use and none was returned to the pool before RequestTimeout
+// elapsed.
+var ErrPoolFull = errors.New("[Node] pool exhausted: no connection became available within RequestTimeout")
+
+// ErrNodeShuttingDown is returned to callers blocked waiting on a pooled
+// connection when the Node is stopped out from under them.
+var ErrNodeShuttingDown = errors.New("[Node] shutting down, connection pool drained")
+
 var defaultNodeOptions = &NodeOptions{
 	RemoteAddress:  defaultRemoteAddress,
 	MinConnections: defaultMinConnections,
@@ -92,16 +136,23 @@ func NewNode(options *NodeOptions) (*Node, error) {
 		options.RequestTimeout = defaultRequestTimeout
 	}
 
+	host := options.RemoteAddress
+	if h, _, err := net.SplitHostPort(options.RemoteAddress); err == nil {
+		host = h
+	}
+
 	if resolvedAddress, err := net.ResolveTCPAddr("tcp", options.RemoteAddress); err == nil {
 		return &Node{
 			addr:               resolvedAddress,
+			host:               host,
 			minConnections:     options.MinConnections,
 			maxConnections:     options.MaxConnections,
 			idleTimeout:        options.IdleTimeout,
 			connectTimeout:     options.ConnectTimeout,
 			requestTimeout:     options.RequestTimeout,
 			healthCheckBuilder: options.HealthCheckBuilder,
-			available:          make([]*connection, options.MinConnections),
+			authOptions:        options.AuthOptions,
+			available:          make(chan *connection, options.MaxConnections),
 			state:              CREATED,
 		}, nil
 	} else {
@@ -109,13 +160,69 @@ func NewNode(options *NodeOptions) (*Node, error) {
 	}
 }
 
+// pooledConnection wraps a *connection checked out of a Node's pool so that
+// callers can give it back via Close() instead of closing the underlying
+// socket, mirroring the fatih/pool Close-returns-to-pool idiom.
+type pooledConnection struct {
+	*connection
+	node *Node
+}
+
+func (pc *pooledConnection) Close() error {
+	pc.node.returnConnectionToPool(pc.connection, true)
+	return nil
+}
+
 // exported funcs
 
 func (n *Node) String() string {
 	return fmt.Sprintf("%v|%d", n.addr, n.currentNumConnections)
 }
 
+// Subscribe registers interest in this Node's state transitions and returns
+// a subscription id (for Unsubscribe) along with the channel events are
+// delivered on. Events for a given subscriber are always delivered in the
+// order the transitions happened.
+func (n *Node) Subscribe() (id uint64, events <-chan StateChangeEvent) {
+	n.subMtx.Lock()
+	defer n.subMtx.Unlock()
+	if n.subscribers == nil {
+		n.subscribers = make(map[uint64]chan StateChangeEvent)
+	}
+	n.nextSubscriberID++
+	id = n.nextSubscriberID
+	ch := make(chan StateChangeEvent, stateChangeEventBuffer)
+	n.subscribers[id] = ch
+	return id, ch
+}
+
+// Unsubscribe removes a subscription previously returned by Subscribe and
+// closes its channel.
+func (n *Node) Unsubscribe(id uint64) {
+	n.subMtx.Lock()
+	defer n.subMtx.Unlock()
+	if ch, ok := n.subscribers[id]; ok {
+		delete(n.subscribers, id)
+		close(ch)
+	}
+}
+
+// Execute runs cmd against this Node using RequestTimeout as the only
+// deadline. It is a thin wrapper around ExecuteContext using
+// context.Background(), kept for callers that don't need per-call
+// cancellation.
 func (n *Node) Execute(cmd Command) (executed bool, err error) {
+	return n.ExecuteContext(context.Background(), cmd)
+}
+
+// ExecuteContext runs cmd against this Node, checking out a pooled
+// connection and returning it when done. ctx can be used to cancel the
+// call or impose a deadline tighter than RequestTimeout; doing so
+// interrupts the in-flight socket read rather than waiting for it to
+// complete. A connection whose request was cancelled is discarded instead
+// of being returned to the pool, since its response may still be in
+// flight on the wire.
+func (n *Node) ExecuteContext(ctx context.Context, cmd Command) (executed bool, err error) {
 	executed = false
 
 	if err = n.stateCheck(RUNNING, HEALTH_CHECKING); err != nil {
@@ -123,20 +230,82 @@ func (n *Node) Execute(cmd Command) (executed bool, err error) {
 	}
 
 	n.stateMtx.RLock()
-	defer n.stateMtx.RUnlock()
-	if n.state == RUNNING {
-		if conn := n.getAvailableConnection(); conn == nil {
-		} else {
-			logDebug("[Node] (%v) - executing command '%v'", n, cmd.Name())
-			if err = conn.execute(cmd); err == nil {
-				executed = true
-			}
+	if n.state != RUNNING {
+		n.stateMtx.RUnlock()
+		return
+	}
+
+	var conn *connection
+	if conn, err = n.getAvailableConnection(ctx); err != nil {
+		n.stateMtx.RUnlock()
+		return
+	}
+
+	logDebug("[Node] (%v) - executing command '%v'", n, cmd.Name())
+	execErr, cancelled := n.executeWithContext(ctx, conn, cmd)
+	n.stateMtx.RUnlock()
+
+	if execErr == nil {
+		executed = true
+		(&pooledConnection{connection: conn, node: n}).Close()
+	} else {
+		err = execErr
+		n.discardConnection(conn)
+		if !cancelled {
+			n.beginHealthCheck()
 		}
 	}
 
 	return
 }
 
+// executeWithContext runs cmd on conn, honoring ctx's deadline and
+// cancellation. A watcher goroutine races ctx.Done() against completion of
+// conn.execute and, if ctx is done first, forces the blocked socket read to
+// return by moving conn's read deadline into the past. cancelled reports
+// whether the watcher actually fired, i.e. whether ctx beat conn.execute to
+// the finish line, rather than merely whether ctx happens to be done by the
+// time conn.execute returns (which, for a ctx created with a deadline equal
+// to RequestTimeout, is routinely also true of a genuine dead-connection
+// failure). The caller uses cancelled to decide whether this failure is a
+// sign of an unhealthy Node.
+func (n *Node) executeWithContext(ctx context.Context, conn *connection, cmd Command) (err error, cancelled bool) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.conn.SetReadDeadline(deadline)
+	}
+
+	done := make(chan struct{})
+	watcherDone := make(chan struct{})
+	var fired bool
+	go func() {
+		defer close(watcherDone)
+		fired = watchContextDone(ctx, conn.conn, done)
+	}()
+
+	err = conn.execute(cmd)
+	close(done)
+	<-watcherDone
+
+	if fired {
+		return ctx.Err(), true
+	}
+	return err, false
+}
+
+// watchContextDone waits for either ctx to be done or done to be closed by
+// the caller once the guarded operation finishes. If ctx wins the race, it
+// interrupts conn's current blocking read by setting its read deadline to
+// the past and reports fired as true.
+func watchContextDone(ctx context.Context, conn net.Conn, done <-chan struct{}) (fired bool) {
+	select {
+	case <-ctx.Done():
+		conn.SetReadDeadline(time.Now())
+		return true
+	case <-done:
+		return false
+	}
+}
+
 func (n *Node) Start() (err error) {
 	if err = n.stateCheck(CREATED); err != nil {
 		return
@@ -151,18 +320,37 @@ func (n *Node) Start() (err error) {
 	}
 	n.connMtx.Unlock()
 
-	// TODO _expireTimer
+	n.stopCh = make(chan struct{})
+	if n.idleTimeout > 0 {
+		n.expireTicker = time.NewTicker(n.idleTimeout)
+		go n.expireConnectionsLoop()
+	}
+
 	n.setState(RUNNING)
-	// TODO emit stateChange event
 	return
 }
 
 func (n *Node) Stop() (err error) {
-	if err = n.stateCheck(CREATED, HEALTH_CHECKING); err != nil {
+	if err = n.stateCheck(RUNNING, HEALTH_CHECKING); err != nil {
 		return
 	}
-	// TODO stop expire timer
-	n.setState(SHUTTING_DOWN)
+	if n.expireTicker != nil {
+		n.expireTicker.Stop()
+	}
+	if n.stopCh != nil {
+		close(n.stopCh)
+	}
+
+	n.stateMtx.Lock()
+	if n.healthCheckStopCh != nil {
+		close(n.healthCheckStopCh)
+		n.healthCheckStopCh = nil
+	}
+	previous := n.state
+	n.state = SHUTTING_DOWN
+	n.stateMtx.Unlock()
+	n.emitStateChange(previous, SHUTTING_DOWN)
+
 	logDebug("[Node] (%v) shutting down.", n)
 	n.shutdown()
 	return
@@ -170,17 +358,65 @@ func (n *Node) Stop() (err error) {
 
 // non-exported funcs
 
-func (n *Node) getAvailableConnection() (c *connection) {
+// getAvailableConnection returns a connection from the pool, creating one
+// lazily if currentNumConnections hasn't yet reached MaxConnections.
+// Otherwise it blocks for a connection to be returned by another caller, up
+// to RequestTimeout or ctx's deadline/cancellation, whichever comes first.
+func (n *Node) getAvailableConnection(ctx context.Context) (c *connection, err error) {
+	select {
+	case c, ok := <-n.available:
+		if !ok {
+			return nil, ErrNodeShuttingDown
+		}
+		return c, nil
+	default:
+	}
+
 	n.connMtx.Lock()
-	defer n.connMtx.Unlock()
+	if n.poolClosed {
+		n.connMtx.Unlock()
+		return nil, ErrNodeShuttingDown
+	}
+	if n.currentNumConnections < n.maxConnections {
+		// Reserve the slot before dialing so the lock isn't held across the
+		// dial/TLS handshake: every other goroutine returning or growing
+		// the pool would otherwise stall for however long that one dial
+		// takes. Roll the reservation back if the dial fails.
+		n.currentNumConnections++
+		n.connMtx.Unlock()
+
+		conn, cerr := n.dialConnection()
+		if cerr != nil {
+			n.connMtx.Lock()
+			n.currentNumConnections--
+			n.connMtx.Unlock()
+			return nil, cerr
+		}
+		return conn, nil
+	}
+	n.connMtx.Unlock()
 
-	c = nil
-	if len(n.available) > 0 {
-		c = n.available[0]
-		n.available = n.available[1:]
+	waitFor := n.requestTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		if remaining := time.Until(deadline); remaining < waitFor {
+			waitFor = remaining
+		}
 	}
 
-	return
+	timer := time.NewTimer(waitFor)
+	defer timer.Stop()
+
+	select {
+	case c, ok := <-n.available:
+		if !ok {
+			return nil, ErrNodeShuttingDown
+		}
+		return c, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer.C:
+		return nil, ErrPoolFull
+	}
 }
 
 func (n *Node) returnConnectionToPool(c *connection, shouldLock bool) {
@@ -188,11 +424,21 @@ func (n *Node) returnConnectionToPool(c *connection, shouldLock bool) {
 		n.connMtx.Lock()
 		defer n.connMtx.Unlock()
 	}
-	if n.state < SHUTTING_DOWN {
+	if n.state < SHUTTING_DOWN && !n.poolClosed {
 		c.notInFlight()
 		c.resetBuffer()
-		n.available = append(n.available, c)
-		logDebug("[Node] (%v)|Number of avail connections: %d", n, len(n.available))
+		c.lastUsed = time.Now()
+		select {
+		case n.available <- c:
+			logDebug("[Node] (%v)|Number of avail connections: %d", n, len(n.available))
+		default:
+			// Pool channel is already at MaxConnections capacity; this
+			// shouldn't normally happen since currentNumConnections is
+			// bounded the same way, but drop the connection rather than
+			// block the caller.
+			n.currentNumConnections--
+			c.close() // NB: discard error
+		}
 	} else {
 		logDebug("[Node] (%v)|Connection returned to pool during shutdown.", n)
 		n.currentNumConnections--
@@ -200,36 +446,111 @@ func (n *Node) returnConnectionToPool(c *connection, shouldLock bool) {
 	}
 }
 
+// expireConnectionsLoop periodically scans the pool for idle connections
+// until stopCh is closed by Stop().
+func (n *Node) expireConnectionsLoop() {
+	for {
+		select {
+		case <-n.expireTicker.C:
+			n.expireIdleConnections()
+		case <-n.stopCh:
+			return
+		}
+	}
+}
+
+// expireIdleConnections closes pooled connections that have been idle for
+// longer than IdleTimeout, never shrinking currentNumConnections below
+// MinConnections.
+func (n *Node) expireIdleConnections() {
+	n.connMtx.Lock()
+	defer n.connMtx.Unlock()
+
+	if n.poolClosed {
+		return
+	}
+
+	pending := len(n.available)
+	now := time.Now()
+	var keep []*connection
+	for i := 0; i < pending; i++ {
+		select {
+		case c := <-n.available:
+			if n.currentNumConnections > n.minConnections && now.Sub(c.lastUsed) > n.idleTimeout {
+				n.currentNumConnections--
+				c.close() // NB: discard error
+				logDebug("[Node] (%v)|expired idle connection", n)
+			} else {
+				keep = append(keep, c)
+			}
+		default:
+		}
+	}
+	for _, c := range keep {
+		n.available <- c
+	}
+}
+
+// shutdown closes every connection currently sitting idle in the pool and
+// marks it closed. Connections checked out at the time Stop() is called are
+// deliberately left alone here: they aren't ours to close out from under an
+// in-flight Execute, and once their caller is done with them,
+// returnConnectionToPool's "returned during shutdown" branch closes them and
+// decrements currentNumConnections as they trickle back in, so the Node
+// doesn't need every connection in hand synchronously to finish shutting
+// down.
 func (n *Node) shutdown() (err error) {
 	n.connMtx.Lock()
 	defer n.connMtx.Unlock()
 
-	for i, conn := range n.available {
-		n.available[i] = nil
+	n.poolClosed = true
+	close(n.available)
+	for conn := range n.available {
 		n.currentNumConnections--
-		err = conn.close()
+		if cerr := conn.close(); cerr != nil {
+			err = cerr
+		}
 	}
 	if err != nil {
 		n.setState(ERROR)
 		return
 	}
 
-	if n.currentNumConnections == 0 {
-		n.setState(SHUTDOWN)
-		logDebug("[Node] (%v) shut down.", n)
-	} else {
-		// Should never happen
-		panic(fmt.Sprintf("[Node] (%v); Connections still in use.", n))
-	}
-
+	n.setState(SHUTDOWN)
+	logDebug("[Node] (%v) shut down.", n)
 	return
 }
 
 func (n *Node) setState(s state) {
 	n.stateMtx.Lock()
-	defer n.stateMtx.Unlock()
+	previous := n.state
 	n.state = s
-	return
+	n.stateMtx.Unlock()
+
+	if previous != s {
+		n.emitStateChange(previous, s)
+	}
+}
+
+// emitStateChange fans a state transition out to every current subscriber.
+// It must never be called while holding stateMtx: a slow or buggy
+// subscriber callback could otherwise deadlock future state transitions.
+func (n *Node) emitStateChange(previous, current state) {
+	n.subMtx.Lock()
+	subscribers := make([]chan StateChangeEvent, 0, len(n.subscribers))
+	for _, ch := range n.subscribers {
+		subscribers = append(subscribers, ch)
+	}
+	n.subMtx.Unlock()
+
+	event := StateChangeEvent{Previous: previous, Current: current}
+	for _, ch := range subscribers {
+		select {
+		case ch <- event:
+		default:
+			logDebug("[Node] (%v)|dropped state change event for slow subscriber", n)
+		}
+	}
 }
 
 func (n *Node) stateCheck(allowed ...state) (err error) {
@@ -248,7 +569,145 @@ func (n *Node) stateCheck(allowed ...state) (err error) {
 	return
 }
 
+// discardConnection removes a connection from the pool's bookkeeping and
+// closes it rather than returning it for reuse, for connections known to be
+// in a bad state (e.g. a failed Execute).
+func (n *Node) discardConnection(c *connection) {
+	n.connMtx.Lock()
+	n.currentNumConnections--
+	n.connMtx.Unlock()
+	c.close() // NB: discard error
+}
+
+// beginHealthCheck transitions the Node into HEALTH_CHECKING, closes the
+// connections still sitting in the pool (they share the same suspect
+// network path), and kicks off a backoff-driven goroutine that keeps
+// re-running the health check command until it succeeds or Stop() cancels
+// it.
+func (n *Node) beginHealthCheck() {
+	n.stateMtx.Lock()
+	if n.state != RUNNING {
+		n.stateMtx.Unlock()
+		return
+	}
+	n.state = HEALTH_CHECKING
+	n.healthCheckStopCh = make(chan struct{})
+	stopCh := n.healthCheckStopCh
+	n.stateMtx.Unlock()
+	n.emitStateChange(RUNNING, HEALTH_CHECKING)
+
+	logDebug("[Node] (%v) health check started.", n)
+	n.drainAvailableConnections()
+	go n.runHealthCheck(stopCh)
+}
+
+// drainAvailableConnections closes every connection currently sitting in
+// the pool without touching ones that are checked out.
+func (n *Node) drainAvailableConnections() {
+	n.connMtx.Lock()
+	defer n.connMtx.Unlock()
+	pending := len(n.available)
+	for i := 0; i < pending; i++ {
+		select {
+		case c := <-n.available:
+			n.currentNumConnections--
+			c.close() // NB: discard error
+		default:
+		}
+	}
+}
+
+// runHealthCheck retries the health check on an exponential backoff
+// (doubling from healthCheckInitialBackoff up to healthCheckMaxBackoff,
+// with jitter to avoid thundering-herd reconnects) until it succeeds or
+// stopCh is closed by Stop().
+func (n *Node) runHealthCheck(stopCh chan struct{}) {
+	backoff := healthCheckInitialBackoff
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(jitter(backoff)):
+		}
+
+		if n.tryHealthCheck() {
+			n.recoverFromHealthCheck()
+			return
+		}
+
+		backoff *= 2
+		if backoff > healthCheckMaxBackoff {
+			backoff = healthCheckMaxBackoff
+		}
+	}
+}
+
+// tryHealthCheck dials a fresh connection and runs the health check command
+// against it, leaving the connection in the pool on success.
+func (n *Node) tryHealthCheck() bool {
+	n.connMtx.Lock()
+	conn, err := n.createNewConnection()
+	n.connMtx.Unlock()
+	if err != nil {
+		return false
+	}
+
+	if n.healthCheckBuilder != nil {
+		if err = conn.execute(n.healthCheckBuilder.Build()); err != nil {
+			n.discardConnection(conn)
+			return false
+		}
+	}
+
+	n.returnConnectionToPool(conn, true)
+	return true
+}
+
+// recoverFromHealthCheck refills the pool up to MinConnections and
+// transitions the Node back to RUNNING.
+func (n *Node) recoverFromHealthCheck() {
+	n.connMtx.Lock()
+	for n.currentNumConnections < n.minConnections {
+		conn, err := n.createNewConnection()
+		if err != nil {
+			break
+		}
+		n.returnConnectionToPool(conn, false)
+	}
+	n.connMtx.Unlock()
+
+	n.stateMtx.Lock()
+	n.healthCheckStopCh = nil
+	n.state = RUNNING
+	n.stateMtx.Unlock()
+	n.emitStateChange(HEALTH_CHECKING, RUNNING)
+
+	logDebug("[Node] (%v) recovered, back to RUNNING.", n)
+}
+
+// jitter returns a random duration in [d/2, d], so retrying Nodes don't all
+// reconnect in lockstep.
+func jitter(d time.Duration) time.Duration {
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half+1)))
+}
+
+// createNewConnection dials a new connection and accounts for it in
+// currentNumConnections. Callers must hold connMtx for its duration, which
+// also means callers on a latency-sensitive path (e.g. getAvailableConnection)
+// should prefer dialConnection plus their own reservation instead, so the
+// dial/handshake doesn't serialize every other pool operation behind it.
 func (n *Node) createNewConnection() (conn *connection, err error) {
+	if conn, err = n.dialConnection(); err == nil {
+		n.currentNumConnections++
+	}
+	return
+}
+
+// dialConnection dials and, if AuthOptions is set, authenticates a new
+// connection without touching currentNumConnections; callers are
+// responsible for their own bookkeeping.
+func (n *Node) dialConnection() (conn *connection, err error) {
 	connectionOptions := &connectionOptions{
 		remoteAddress:  n.addr,
 		connectTimeout: n.connectTimeout,
@@ -264,7 +723,13 @@ func (n *Node) createNewConnection() (conn *connection, err error) {
 
 	if conn, err = newConnection(connectionOptions); err == nil {
 		if err = conn.connect(); err == nil {
-			n.currentNumConnections++
+			if n.authOptions != nil {
+				if err = n.startTlsAndAuth(conn); err != nil {
+					conn.close() // NB: discard error, err above takes precedence
+					conn = nil
+					return
+				}
+			}
 			return
 		}
 	}
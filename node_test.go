@@ -0,0 +1,468 @@
+package riak
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startTestListener starts a TCP listener that silently accepts and holds
+// connections open so Node.createNewConnection() can succeed against it.
+func startTestListener(t *testing.T) (addr string, stop func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start test listener: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				<-done
+				conn.Close()
+			}()
+		}
+	}()
+
+	return ln.Addr().String(), func() {
+		close(done)
+		ln.Close()
+	}
+}
+
+func testNode(t *testing.T, addr string, min, max uint16) *Node {
+	n, err := NewNode(&NodeOptions{
+		RemoteAddress:  addr,
+		MinConnections: min,
+		MaxConnections: max,
+		RequestTimeout: 200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewNode() returned error: %v", err)
+	}
+	if err = n.Start(); err != nil {
+		t.Fatalf("Start() returned error: %v", err)
+	}
+	return n
+}
+
+func TestNode_PoolExhaustion(t *testing.T) {
+	addr, stop := startTestListener(t)
+	defer stop()
+
+	n := testNode(t, addr, 0, 1)
+	defer n.Stop()
+
+	conn, err := n.getAvailableConnection(context.Background())
+	if err != nil {
+		t.Fatalf("getAvailableConnection() returned error: %v", err)
+	}
+	if conn == nil {
+		t.Fatal("expected a connection, got nil")
+	}
+
+	start := time.Now()
+	if _, err = n.getAvailableConnection(context.Background()); err != ErrPoolFull {
+		t.Fatalf("expected ErrPoolFull, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < n.requestTimeout {
+		t.Fatalf("expected to block for at least RequestTimeout, elapsed %v", elapsed)
+	}
+
+	n.returnConnectionToPool(conn, true)
+}
+
+func TestNode_ConcurrentAcquireRelease(t *testing.T) {
+	addr, stop := startTestListener(t)
+	defer stop()
+
+	n := testNode(t, addr, 0, 4)
+	defer n.Stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := n.getAvailableConnection(context.Background())
+			if err != nil {
+				t.Errorf("getAvailableConnection() returned error: %v", err)
+				return
+			}
+			n.returnConnectionToPool(conn, true)
+		}()
+	}
+	wg.Wait()
+
+	if n.currentNumConnections > n.maxConnections {
+		t.Fatalf("currentNumConnections %d exceeded MaxConnections %d", n.currentNumConnections, n.maxConnections)
+	}
+}
+
+// TestNode_GetAvailableConnectionRollsBackReservationOnDialFailure verifies
+// getAvailableConnection's lazy-create path: it reserves a slot in
+// currentNumConnections before dialing (so connMtx isn't held across the
+// dial), and rolls that reservation back if the dial fails rather than
+// leaking a phantom connection.
+func TestNode_GetAvailableConnectionRollsBackReservationOnDialFailure(t *testing.T) {
+	addr, stop := startTestListener(t)
+	stop() // close immediately so dials to addr fail
+
+	n := testNode(t, addr, 0, 1)
+	defer n.Stop()
+
+	if _, err := n.getAvailableConnection(context.Background()); err == nil {
+		t.Fatal("expected getAvailableConnection() to fail when the dial fails")
+	}
+
+	n.connMtx.RLock()
+	got := n.currentNumConnections
+	n.connMtx.RUnlock()
+	if got != 0 {
+		t.Fatalf("expected the reservation to be rolled back to 0, got %d", got)
+	}
+}
+
+func TestNode_ShutdownUnblocksWaiters(t *testing.T) {
+	addr, stop := startTestListener(t)
+	defer stop()
+
+	n := testNode(t, addr, 0, 1)
+
+	conn, err := n.getAvailableConnection(context.Background())
+	if err != nil {
+		t.Fatalf("getAvailableConnection() returned error: %v", err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, werr := n.getAvailableConnection(context.Background())
+		errCh <- werr
+	}()
+
+	// give the waiter time to block on the empty pool
+	time.Sleep(20 * time.Millisecond)
+
+	n.setState(SHUTTING_DOWN)
+	n.shutdown()
+
+	select {
+	case werr := <-errCh:
+		if werr != ErrNodeShuttingDown {
+			t.Fatalf("expected ErrNodeShuttingDown, got %v", werr)
+		}
+	case <-time.After(n.requestTimeout):
+		t.Fatal("waiter was not unblocked by shutdown")
+	}
+
+	n.returnConnectionToPool(conn, true)
+}
+
+func TestNode_ExpireIdleConnectionsFloorsAtMin(t *testing.T) {
+	addr, stop := startTestListener(t)
+	defer stop()
+
+	n, err := NewNode(&NodeOptions{
+		RemoteAddress:  addr,
+		MinConnections: 1,
+		MaxConnections: 3,
+		IdleTimeout:    10 * time.Millisecond,
+		RequestTimeout: 200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewNode() returned error: %v", err)
+	}
+	if err = n.Start(); err != nil {
+		t.Fatalf("Start() returned error: %v", err)
+	}
+	defer n.Stop()
+
+	var extra []*connection
+	for i := 0; i < 2; i++ {
+		c, cerr := n.getAvailableConnection(context.Background())
+		if cerr != nil {
+			t.Fatalf("getAvailableConnection() returned error: %v", cerr)
+		}
+		extra = append(extra, c)
+	}
+	for _, c := range extra {
+		n.returnConnectionToPool(c, true)
+	}
+
+	// age every pooled connection well past IdleTimeout
+	stale := time.Now().Add(-time.Hour)
+	n.connMtx.Lock()
+	pending := len(n.available)
+	var aged []*connection
+	for i := 0; i < pending; i++ {
+		c := <-n.available
+		c.lastUsed = stale
+		aged = append(aged, c)
+	}
+	for _, c := range aged {
+		n.available <- c
+	}
+	n.connMtx.Unlock()
+
+	n.expireIdleConnections()
+
+	if n.currentNumConnections != n.minConnections {
+		t.Fatalf("expected currentNumConnections to floor at MinConnections (%d), got %d", n.minConnections, n.currentNumConnections)
+	}
+}
+
+func TestPooledConnection_CloseReturnsToPool(t *testing.T) {
+	addr, stop := startTestListener(t)
+	defer stop()
+
+	n := testNode(t, addr, 0, 1)
+	defer n.Stop()
+
+	conn, err := n.getAvailableConnection(context.Background())
+	if err != nil {
+		t.Fatalf("getAvailableConnection() returned error: %v", err)
+	}
+
+	pooled := &pooledConnection{connection: conn, node: n}
+	if err = pooled.Close(); err != nil {
+		t.Fatalf("pooledConnection.Close() returned error: %v", err)
+	}
+
+	select {
+	case back := <-n.available:
+		if back != conn {
+			t.Fatal("expected the same connection to be returned to the pool")
+		}
+	default:
+		t.Fatal("expected connection to be back in the pool after Close()")
+	}
+}
+
+func TestJitter_StaysWithinBounds(t *testing.T) {
+	d := 200 * time.Millisecond
+	for i := 0; i < 100; i++ {
+		j := jitter(d)
+		if j < d/2 || j > d {
+			t.Fatalf("jitter(%v) = %v, want value in [%v, %v]", d, j, d/2, d)
+		}
+	}
+}
+
+func TestNode_HealthCheckBackoffAndCancellation(t *testing.T) {
+	addr, stop := startTestListener(t)
+
+	n, err := NewNode(&NodeOptions{
+		RemoteAddress:  addr,
+		MinConnections: 1,
+		MaxConnections: 2,
+		RequestTimeout: 200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewNode() returned error: %v", err)
+	}
+	if err = n.Start(); err != nil {
+		t.Fatalf("Start() returned error: %v", err)
+	}
+
+	// kill the listener so every reconnect attempt fails
+	stop()
+
+	n.beginHealthCheck()
+
+	n.stateMtx.RLock()
+	st := n.state
+	n.stateMtx.RUnlock()
+	if st != HEALTH_CHECKING {
+		t.Fatalf("expected HEALTH_CHECKING after beginHealthCheck(), got %v", st)
+	}
+
+	// let a couple of failed backoff attempts go by
+	time.Sleep(250 * time.Millisecond)
+
+	if err = n.Stop(); err != nil {
+		t.Fatalf("Stop() returned error: %v", err)
+	}
+
+	n.stateMtx.RLock()
+	st = n.state
+	n.stateMtx.RUnlock()
+	if st != SHUTDOWN {
+		t.Fatalf("expected SHUTDOWN after Stop(), got %v", st)
+	}
+}
+
+func TestNode_HealthCheckRecovers(t *testing.T) {
+	addr, stop := startTestListener(t)
+
+	n, err := NewNode(&NodeOptions{
+		RemoteAddress:  addr,
+		MinConnections: 1,
+		MaxConnections: 2,
+		RequestTimeout: 200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewNode() returned error: %v", err)
+	}
+	if err = n.Start(); err != nil {
+		t.Fatalf("Start() returned error: %v", err)
+	}
+	defer n.Stop()
+
+	stop() // reconnect attempts fail until we relisten below
+
+	n.beginHealthCheck()
+
+	time.Sleep(150 * time.Millisecond)
+
+	ln, lerr := net.Listen("tcp", addr)
+	if lerr != nil {
+		t.Skipf("could not relisten on %s: %v", addr, lerr)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, aerr := ln.Accept()
+			if aerr != nil {
+				return
+			}
+			go io.Copy(io.Discard, c)
+		}
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	var st state
+	for time.Now().Before(deadline) {
+		n.stateMtx.RLock()
+		st = n.state
+		n.stateMtx.RUnlock()
+		if st == RUNNING {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if st != RUNNING {
+		t.Fatalf("expected node to recover to RUNNING, stuck at %v", st)
+	}
+	if n.currentNumConnections < n.minConnections {
+		t.Fatalf("expected pool refilled to MinConnections, got %d", n.currentNumConnections)
+	}
+}
+
+func TestNode_SubscribeMultipleSubscribersAndOrdering(t *testing.T) {
+	addr, stop := startTestListener(t)
+	defer stop()
+
+	n := testNode(t, addr, 0, 1)
+	defer n.Stop()
+
+	_, events1 := n.Subscribe()
+	_, events2 := n.Subscribe()
+
+	n.setState(HEALTH_CHECKING)
+	n.setState(RUNNING)
+
+	for _, events := range []<-chan StateChangeEvent{events1, events2} {
+		first := <-events
+		if first.Previous != RUNNING || first.Current != HEALTH_CHECKING {
+			t.Fatalf("expected RUNNING->HEALTH_CHECKING first, got %+v", first)
+		}
+		second := <-events
+		if second.Previous != HEALTH_CHECKING || second.Current != RUNNING {
+			t.Fatalf("expected HEALTH_CHECKING->RUNNING second, got %+v", second)
+		}
+	}
+}
+
+func TestNode_Unsubscribe(t *testing.T) {
+	addr, stop := startTestListener(t)
+	defer stop()
+
+	n := testNode(t, addr, 0, 1)
+	defer n.Stop()
+
+	id, events := n.Subscribe()
+	n.Unsubscribe(id)
+
+	n.setState(HEALTH_CHECKING)
+
+	if _, ok := <-events; ok {
+		t.Fatal("expected events channel to be closed after Unsubscribe")
+	}
+}
+
+// TestWatchContextDone_CancelInterruptsBlockingRead exercises the
+// SetReadDeadline-based cancellation watchContextDone relies on: a Read
+// blocked on a socket that never sees a response must return promptly once
+// the context driving the call is cancelled.
+func TestWatchContextDone_CancelInterruptsBlockingRead(t *testing.T) {
+	addr, stop := startTestListener(t)
+	defer stop()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial test listener: %v", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go watchContextDone(ctx, conn, done)
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		readErr <- err
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	close(done)
+
+	select {
+	case err := <-readErr:
+		if err == nil {
+			t.Fatal("expected Read to fail once the read deadline was forced into the past")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("cancelling the context did not unblock the pending Read")
+	}
+}
+
+// TestNode_DiscardAfterCancelDoesNotPoisonPool discards a checked-out
+// connection the way ExecuteContext does after a cancelled request, and
+// verifies the Node can still produce a connection afterward rather than
+// being left wedged. It does not call ExecuteContext itself.
+func TestNode_DiscardAfterCancelDoesNotPoisonPool(t *testing.T) {
+	addr, stop := startTestListener(t)
+	defer stop()
+
+	n := testNode(t, addr, 0, 1)
+	defer n.Stop()
+
+	conn, err := n.getAvailableConnection(context.Background())
+	if err != nil {
+		t.Fatalf("getAvailableConnection() returned error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Simulate what ExecuteContext does when executeWithContext reports the
+	// failure was due to ctx: discard rather than return to the pool.
+	if ctx.Err() == nil {
+		t.Fatal("expected cancelled context to report an error")
+	}
+	n.discardConnection(conn)
+
+	if _, err = n.getAvailableConnection(context.Background()); err != nil {
+		t.Fatalf("pool appears poisoned after discarding a cancelled connection: %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+package riak
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+// NodeManager picks which of a set of healthy nodes should run a Command
+// and is responsible for retrying against other candidates itself; a
+// Cluster calls ExecuteOnNode exactly once per Execute() and trusts the
+// NodeManager to have exhausted its own retry budget by the time it
+// returns. previous is the last node the Cluster knows to have failed for
+// this command (nil on a fresh Execute() call) so a NodeManager can avoid
+// immediately re-selecting it.
+type NodeManager interface {
+	ExecuteOnNode(nodes []*Node, cmd Command, previous *Node) (executed bool, err error)
+}
+
+// keyedCommand is implemented by Commands that target a specific Riak
+// bucket/key pair. RendezvousNodeManager uses it to consistently steer a
+// given key to the same node; Commands that don't implement it are tried
+// in the order the nodes were given.
+type keyedCommand interface {
+	Command
+	Bucket() string
+	Key() string
+}
+
+// RoundRobinNodeManager is the default NodeManager: it cycles through the
+// supplied nodes in rotation, retrying on the next one in line on failure.
+type RoundRobinNodeManager struct {
+	mtx      sync.Mutex
+	next     int
+	Attempts int
+}
+
+// NewRoundRobinNodeManager returns a RoundRobinNodeManager that retries up
+// to attempts distinct nodes per ExecuteOnNode call. attempts <= 0 means
+// "try every node given".
+func NewRoundRobinNodeManager(attempts int) *RoundRobinNodeManager {
+	return &RoundRobinNodeManager{Attempts: attempts}
+}
+
+func (m *RoundRobinNodeManager) ExecuteOnNode(nodes []*Node, cmd Command, previous *Node) (executed bool, err error) {
+	if len(nodes) == 0 {
+		return false, ErrNoHealthyNodes
+	}
+
+	attempts := m.Attempts
+	if attempts <= 0 || attempts > len(nodes) {
+		attempts = len(nodes)
+	}
+
+	start := m.nextIndex(len(nodes))
+	tried := 0
+	for i := 0; tried < attempts && i < len(nodes); i++ {
+		node := nodes[(start+i)%len(nodes)]
+		if node == previous {
+			continue
+		}
+		tried++
+		if executed, err = node.Execute(cmd); executed {
+			return
+		}
+	}
+	return false, err
+}
+
+func (m *RoundRobinNodeManager) nextIndex(n int) int {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	idx := m.next % n
+	m.next++
+	return idx
+}
+
+// RendezvousNodeManager selects a node using rendezvous (highest random
+// weight) hashing over the command's bucket+key, so repeated calls for the
+// same key are consistently steered to the same node while only ~1/N keys
+// move when the node set changes. Commands without a bucket/key (i.e. that
+// don't implement keyedCommand) fall back to the order nodes were given.
+type RendezvousNodeManager struct {
+	Attempts int
+}
+
+// NewRendezvousNodeManager returns a RendezvousNodeManager that retries up
+// to attempts distinct ranked candidates per ExecuteOnNode call. attempts
+// <= 0 means "try every node given".
+func NewRendezvousNodeManager(attempts int) *RendezvousNodeManager {
+	return &RendezvousNodeManager{Attempts: attempts}
+}
+
+func (m *RendezvousNodeManager) ExecuteOnNode(nodes []*Node, cmd Command, previous *Node) (executed bool, err error) {
+	if len(nodes) == 0 {
+		return false, ErrNoHealthyNodes
+	}
+
+	ranked := m.rankNodes(nodes, cmd)
+
+	attempts := m.Attempts
+	if attempts <= 0 || attempts > len(ranked) {
+		attempts = len(ranked)
+	}
+
+	tried := 0
+	for _, node := range ranked {
+		if tried >= attempts {
+			break
+		}
+		if node == previous {
+			continue
+		}
+		tried++
+		if executed, err = node.Execute(cmd); executed {
+			return
+		}
+	}
+	return false, err
+}
+
+// rankNodes orders nodes by rendezvous score for cmd's bucket/key, highest
+// first. Commands without a bucket/key keep the order they were given in.
+func (m *RendezvousNodeManager) rankNodes(nodes []*Node, cmd Command) []*Node {
+	keyed, ok := cmd.(keyedCommand)
+	if !ok {
+		return nodes
+	}
+
+	key := keyed.Bucket() + "/" + keyed.Key()
+	byID := make(map[string]*Node, len(nodes))
+	ids := make([]string, len(nodes))
+	for i, n := range nodes {
+		// n.addr.String() is used rather than n.String(), which bakes in
+		// currentNumConnections and would make the hash input drift on
+		// every connect/return/expiry cycle, defeating the "same key same
+		// node" guarantee rendezvousRank exists to provide.
+		id := n.addr.String()
+		byID[id] = n
+		ids[i] = id
+	}
+
+	ranked := make([]*Node, len(ids))
+	for i, id := range rendezvousRank(ids, key) {
+		ranked[i] = byID[id]
+	}
+	return ranked
+}
+
+// rendezvousRank returns nodeIDs ordered by descending rendezvousHash(id,
+// key), the core of HRW/rendezvous hashing: the top of this ranking only
+// changes for ~1/len(nodeIDs) of keys when a single id is added or removed.
+func rendezvousRank(nodeIDs []string, key string) []string {
+	type scored struct {
+		id    string
+		score uint64
+	}
+
+	scores := make([]scored, len(nodeIDs))
+	for i, id := range nodeIDs {
+		scores[i] = scored{id: id, score: rendezvousHash(id, key)}
+	}
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].score != scores[j].score {
+			return scores[i].score > scores[j].score
+		}
+		return scores[i].id < scores[j].id
+	})
+
+	ranked := make([]string, len(scores))
+	for i, s := range scores {
+		ranked[i] = s.id
+	}
+	return ranked
+}
+
+func rendezvousHash(nodeID, key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(nodeID))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	return h.Sum64()
+}
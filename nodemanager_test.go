@@ -0,0 +1,70 @@
+package riak
+
+import "testing"
+
+func TestRendezvousRank_ConsistentForSameKey(t *testing.T) {
+	nodeIDs := []string{"a", "b", "c", "d"}
+
+	first := rendezvousRank(nodeIDs, "bucket/key1")
+	for i := 0; i < 10; i++ {
+		again := rendezvousRank(nodeIDs, "bucket/key1")
+		if again[0] != first[0] {
+			t.Fatalf("expected consistent top pick for the same key, got %q then %q", first[0], again[0])
+		}
+	}
+}
+
+func TestRendezvousRank_MinimalDisruptionOnNodeAdd(t *testing.T) {
+	before := []string{"node-1", "node-2", "node-3", "node-4"}
+	after := append(append([]string{}, before...), "node-5")
+
+	const sampleSize = 2000
+	moved := 0
+	for i := 0; i < sampleSize; i++ {
+		key := randomKey(i)
+		top1 := rendezvousRank(before, key)[0]
+		top2 := rendezvousRank(after, key)[0]
+		if top1 != top2 {
+			moved++
+		}
+	}
+
+	// Adding one node to five should move at most ~1/5th of keys; allow
+	// generous slack for hash variance.
+	maxExpectedMoved := sampleSize / len(after) * 2
+	if moved > maxExpectedMoved {
+		t.Fatalf("expected at most ~%d/%d keys to move, got %d", maxExpectedMoved, sampleSize, moved)
+	}
+}
+
+func randomKey(i int) string {
+	return "key-" + string(rune('a'+i%26)) + string(rune(i))
+}
+
+func TestRoundRobinNodeManager_NextIndexRotates(t *testing.T) {
+	m := NewRoundRobinNodeManager(0)
+	const n = 3
+	seen := make([]int, 2*n)
+	for i := range seen {
+		seen[i] = m.nextIndex(n)
+	}
+	for i, idx := range seen {
+		if want := i % n; idx != want {
+			t.Fatalf("nextIndex() call %d = %d, want %d", i, idx, want)
+		}
+	}
+}
+
+func TestRendezvousNodeManager_NonKeyedCommandKeepsOrder(t *testing.T) {
+	m := NewRendezvousNodeManager(0)
+	nodes := []*Node{{addr: nil}, {addr: nil}}
+	ranked := m.rankNodes(nodes, plainTestCommand{})
+	if len(ranked) != len(nodes) || ranked[0] != nodes[0] || ranked[1] != nodes[1] {
+		t.Fatalf("expected non-keyed command to keep original node order")
+	}
+}
+
+// plainTestCommand satisfies Command but not keyedCommand.
+type plainTestCommand struct{}
+
+func (plainTestCommand) Name() string { return "plainTestCommand" }